@@ -2,6 +2,7 @@ package broadlinkzard
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
@@ -10,7 +11,10 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
 	"time"
+
+	"github.com/sayzard/broadlinkzard/packet"
 )
 
 // BroadlinkDeviceInterface : Common Interface
@@ -29,24 +33,47 @@ type BroadlinkDeviceInterface interface {
 	QueryPowerRaw() (uint, error)
 }
 
+// Endpoint : A network peer address used by a Bind
+type Endpoint struct {
+	Addr *net.UDPAddr
+}
+
+func (e Endpoint) String() string {
+	if e.Addr == nil {
+		return ""
+	}
+	return e.Addr.String()
+}
+
+// Bind : Abstracts the transport a BroadlinkDevice sends and receives
+// packets over, so devices can be unit tested with NewMemoryBind or pointed
+// at a custom socket (e.g. one bound to a specific interface) instead of
+// always opening a real UDP socket via NewUDPBind.
+type Bind interface {
+	Send(packet []byte, dst Endpoint) error
+	Receive() ([]byte, Endpoint, error)
+	Close()
+}
+
 // BroadlinkDevice : Device Structure
 type BroadlinkDevice struct {
-	DevID     uint32
-	DevType   uint16
-	IPAddr    *net.UDPAddr
-	HwMac     [6]byte
-	bcastAddr *net.UDPAddr
+	DevID   uint32
+	DevType uint16
+	Peer    Endpoint
+	HwMac   [6]byte
 
 	encKey []byte
 	encIv  []byte
 
-	CS        *net.UDPConn
+	bind      Bind
 	SendCount uint16
 
 	TimeoutDefault time.Duration
 	LogLevel       int
 
-	responses chan ([]byte)
+	responsesLock sync.Mutex
+	responses     map[uint16]chan []byte
+	unsolicited   chan []byte
 
 	BroadlinkDeviceInterface
 }
@@ -61,6 +88,26 @@ type BroadlinkDeviceMp1 struct {
 	BroadlinkDevice
 }
 
+// BroadlinkDeviceRm : Device Structure for RM2/RM3/RM4 IR/RF hubs
+type BroadlinkDeviceRm struct {
+	BroadlinkDevice
+}
+
+// BroadlinkDeviceA1 : Device Structure for A1 environmental sensors
+type BroadlinkDeviceA1 struct {
+	BroadlinkDevice
+}
+
+// SensorReading : A single A1 sensor poll result, as published by StreamSensors
+type SensorReading struct {
+	Temp       float32
+	Humidity   float32
+	Light      uint8
+	AirQuality uint8
+	Noise      uint8
+	Err        error
+}
+
 // NewBroadlinkDirectDevice : Create Device Structure with Detail Information
 func NewBroadlinkDirectDevice(iType uint16, sIP string, sMac string) BroadlinkDeviceInterface {
 
@@ -74,6 +121,14 @@ func NewBroadlinkDirectDevice(iType uint16, sIP string, sMac string) BroadlinkDe
 		fmt.Println(err.Error())
 		return nil
 	}
+	return newBroadlinkDevice(iType, sAddr, hwMac)
+}
+
+// newBroadlinkDevice : Build the right device structure for a device type,
+// shared by NewBroadlinkDirectDevice and Discover so both return the same
+// interface.
+func newBroadlinkDevice(iType uint16, sAddr *net.UDPAddr, hwMac net.HardwareAddr) BroadlinkDeviceInterface {
+	peer := Endpoint{Addr: sAddr}
 	switch iType {
 	case
 		0x2711,                         // SP2
@@ -89,7 +144,7 @@ func NewBroadlinkDirectDevice(iType uint16, sIP string, sMac string) BroadlinkDe
 		0x2736: //SPMiniPlus
 		var devsp2 BroadlinkDeviceSp2
 		devsp2.DevType = iType
-		devsp2.IPAddr = sAddr
+		devsp2.Peer = peer
 		copy(devsp2.HwMac[:], hwMac[:6])
 		devsp2.initVars()
 		return &devsp2
@@ -98,16 +153,197 @@ func NewBroadlinkDirectDevice(iType uint16, sIP string, sMac string) BroadlinkDe
 		0x4EF7:
 		var devmp1 BroadlinkDeviceMp1
 		devmp1.DevType = iType
-		devmp1.IPAddr = sAddr
+		devmp1.Peer = peer
 		copy(devmp1.HwMac[:], hwMac[:6])
 		devmp1.initVars()
 		return &devmp1
+	case
+		0x2712, 0x272a, 0x2787, 0x2789, 0x27c2, 0x27c7, // RM2
+		0x27cc, 0x27cd, 0x27d0, 0x27d1, 0x27d3, 0x27de, // RM3
+		0x5f36, 0x6026, 0x61a2, 0x649b, 0x653c: // RM4
+		var devrm BroadlinkDeviceRm
+		devrm.DevType = iType
+		devrm.Peer = peer
+		copy(devrm.HwMac[:], hwMac[:6])
+		devrm.initVars()
+		return &devrm
+	case
+		0x2714: // A1
+		var deva1 BroadlinkDeviceA1
+		deva1.DevType = iType
+		deva1.Peer = peer
+		copy(deva1.HwMac[:], hwMac[:6])
+		deva1.initVars()
+		return &deva1
 	}
 	var dev BroadlinkDevice
+	dev.DevType = iType
+	dev.Peer = peer
+	copy(dev.HwMac[:], hwMac[:6])
 	dev.initVars()
 	return &dev
 }
 
+// Discover : Locate Broadlink devices on the local network by broadcasting a
+// UDP hello packet and collecting the replies until timeout elapses
+func Discover(timeout time.Duration, localIP net.IP) ([]BroadlinkDeviceInterface, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	bcastAddr, err := net.ResolveUDPAddr("udp4", "255.255.255.255:80")
+	if err != nil {
+		return nil, err
+	}
+
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	hello, err := buildHelloPacket(localIP, localPort)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(hello, bcastAddr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	seen := make(map[string]bool)
+	var devices []BroadlinkDeviceInterface
+
+	buf := make([]byte, 2048)
+	for {
+		count, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		var hello packet.HelloResponse
+		if err := hello.Decode(buf[:count]); err != nil {
+			continue
+		}
+
+		macKey := hello.Mac.String()
+		if seen[macKey] {
+			continue
+		}
+		seen[macKey] = true
+
+		sAddr := &net.UDPAddr{IP: hello.IP, Port: 80}
+		devices = append(devices, newBroadlinkDevice(hello.DevType, sAddr, hello.Mac))
+	}
+
+	return devices, nil
+}
+
+// buildHelloPacket : Build the 0x30-byte discovery hello packet broadcast by Discover
+func buildHelloPacket(localIP net.IP, localPort int) ([]byte, error) {
+	return (&packet.HelloRequest{LocalIP: localIP, LocalPort: localPort, Now: time.Now()}).Encode()
+}
+
+// udpBind : Default Bind backed by a real UDP socket
+type udpBind struct {
+	conn *net.UDPConn
+}
+
+// NewUDPBind : Create the default Bind implementation. An empty localAddr
+// listens on an ephemeral port on all interfaces; pass e.g. "0.0.0.0:12345"
+// or a pre-bound listener wrapped by a custom Bind to pin the socket.
+func NewUDPBind(localAddr string) (Bind, error) {
+	addr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+	if localAddr != "" {
+		resolved, err := net.ResolveUDPAddr("udp4", localAddr)
+		if err != nil {
+			return nil, err
+		}
+		addr = resolved
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpBind{conn: conn}, nil
+}
+
+func (b *udpBind) Send(packet []byte, dst Endpoint) error {
+	_, err := b.conn.WriteToUDP(packet, dst.Addr)
+	return err
+}
+
+func (b *udpBind) Receive() ([]byte, Endpoint, error) {
+	buf := make([]byte, 2048)
+	count, addr, err := b.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, Endpoint{}, err
+	}
+	return buf[:count], Endpoint{Addr: addr}, nil
+}
+
+func (b *udpBind) Close() {
+	b.conn.Close()
+}
+
+type memoryPacket struct {
+	Packet []byte
+	Peer   Endpoint
+}
+
+// MemoryBind : A Bind that loops packets in-process instead of touching a
+// real socket, so a fake device can be driven from a test. Packets handed to
+// Send land on Sent; call Deliver to hand a canned response back to the
+// device's next Receive.
+type MemoryBind struct {
+	Sent   chan memoryPacket
+	inbox  chan memoryPacket
+	closed chan struct{}
+}
+
+// NewMemoryBind : Create a MemoryBind for tests
+func NewMemoryBind() *MemoryBind {
+	return &MemoryBind{
+		Sent:   make(chan memoryPacket, 100),
+		inbox:  make(chan memoryPacket, 100),
+		closed: make(chan struct{}),
+	}
+}
+
+func (b *MemoryBind) Send(packet []byte, dst Endpoint) error {
+	cp := make([]byte, len(packet))
+	copy(cp, packet)
+	select {
+	case b.Sent <- memoryPacket{Packet: cp, Peer: dst}:
+	default:
+	}
+	return nil
+}
+
+func (b *MemoryBind) Receive() ([]byte, Endpoint, error) {
+	select {
+	case p := <-b.inbox:
+		return p.Packet, p.Peer, nil
+	case <-b.closed:
+		return nil, Endpoint{}, errors.New("bind closed")
+	}
+}
+
+// Deliver : Inject a fake inbound packet, as if it arrived from src, so a
+// test can hand the device a canned response
+func (b *MemoryBind) Deliver(packet []byte, src Endpoint) {
+	cp := make([]byte, len(packet))
+	copy(cp, packet)
+	b.inbox <- memoryPacket{Packet: cp, Peer: src}
+}
+
+// Close : Close
+func (b *MemoryBind) Close() {
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+}
+
 func (dev *BroadlinkDevice) initVars() {
 	dev.encKey = []byte{0x09, 0x76, 0x28, 0x34, 0x3f, 0xe9, 0x9e, 0x23, 0x76, 0x5c, 0x15, 0x13, 0xac, 0xcf, 0x8b, 0x02}
 	dev.encIv = []byte{0x56, 0x2e, 0x17, 0x99, 0x6d, 0x09, 0x3d, 0x28, 0xdd, 0xb3, 0xba, 0x69, 0x5a, 0x2e, 0x6f, 0x58}
@@ -115,9 +351,11 @@ func (dev *BroadlinkDevice) initVars() {
 
 	dev.TimeoutDefault = time.Duration(10)
 	dev.LogLevel = 1
-	dev.CS, _ = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-	dev.bcastAddr, _ = net.ResolveUDPAddr("udp4", "255.255.255.255:80")
-	dev.responses = make(chan []byte, 1000)
+	if dev.bind == nil {
+		dev.bind, _ = NewUDPBind("")
+	}
+	dev.responses = make(map[uint16]chan []byte)
+	dev.unsolicited = make(chan []byte, 1000)
 	go dev.udpListener()
 }
 
@@ -135,29 +373,56 @@ func (dev *BroadlinkDevice) LogMessage(level int, message string) {
 
 // Close : Close
 func (dev *BroadlinkDevice) Close() {
-	if dev.CS != nil {
+	dev.responsesLock.Lock()
+	bind := dev.bind
+	dev.bind = nil
+	dev.responsesLock.Unlock()
+
+	if bind != nil {
 		dev.LogMessage(10, "Close\n")
-		dev.CS.Close()
-		dev.CS = nil
+		bind.Close()
 	}
 }
 
+func (dev *BroadlinkDevice) getBind() Bind {
+	dev.responsesLock.Lock()
+	defer dev.responsesLock.Unlock()
+	return dev.bind
+}
+
 func (dev *BroadlinkDevice) udpListener() {
+	// Capture bind once: Close() may concurrently set dev.bind to nil, and
+	// re-reading the field on every iteration would race with that write.
+	bind := dev.getBind()
 	for {
-		buf := make([]byte, 2048)
-		count, _, err := dev.CS.ReadFrom(buf)
-
+		buf, _, err := bind.Receive()
 		if err != nil {
-			if count == 0 {
-				break
-			}
+			break
+		}
+
+		if !checkChecksum(buf, 0x20) {
+			continue
+		}
+		response := make([]byte, len(buf))
+		copy(response, buf)
+
+		sendCount := binary.LittleEndian.Uint16(response[0x28:0x2a])
+
+		dev.responsesLock.Lock()
+		ch, ok := dev.responses[sendCount]
+		if ok {
+			delete(dev.responses, sendCount)
+		}
+		dev.responsesLock.Unlock()
+
+		if ok {
+			ch <- response
 			continue
 		}
 
-		if checkChecksum(buf, 0x20) {
-			response := make([]byte, count)
-			copy(response, buf)
-			dev.responses <- response
+		select {
+		case dev.unsolicited <- response:
+		default:
 		}
 	}
 }
@@ -196,15 +461,12 @@ func (dev *BroadlinkDevice) QueryPowerRaw() (uint, error) {
 
 // SetPower : On/Off Power Control
 func (dev *BroadlinkDeviceSp2) SetPower(onstate bool) (bool, error) {
-	payload := make([]byte, 16)
-	payload[0] = 2
-	if onstate {
-		payload[4] = 1
-	} else {
-		payload[4] = 0
+	payload, err := (&packet.Sp2PowerSet{On: onstate}).Encode()
+	if err != nil {
+		return false, err
 	}
 	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
-	_, err := dev.SendPacket(0x6a, payload)
+	_, err = dev.SendPacket(0x6a, payload)
 	if err != nil {
 		return false, err
 	}
@@ -213,45 +475,59 @@ func (dev *BroadlinkDeviceSp2) SetPower(onstate bool) (bool, error) {
 
 // QueryPower : Query Power
 func (dev *BroadlinkDeviceSp2) QueryPower() (bool, error) {
-	payload := make([]byte, 16)
-	payload[0] = 1
+	var query packet.Sp2PowerQueryResp
+	payload, err := query.Encode()
+	if err != nil {
+		return false, err
+	}
 	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
 	resp, err := dev.SendPacket(0x6a, payload)
 	if err != nil {
 		return false, err
 	}
-	ierr := binary.LittleEndian.Uint16(resp[0x22:])
-	dev.LogMessage(10, fmt.Sprintln("RESP=", resp[0x22], resp[0x23], ierr))
-	if ierr != 0 {
-		return false, fmt.Errorf("Response %x", ierr)
-	}
-	dpayload, err := decrypt(dev.encKey, dev.encIv, resp[0x38:])
+	frame, err := dev.decodeFrame(resp)
 	if err != nil {
 		return false, err
 	}
-	if dpayload[0x4] == 1 || dpayload[4] == 3 || dpayload[4] == 0xfd {
-		return true, nil
+	var result packet.Sp2PowerQueryResp
+	if err := result.Decode(frame.Payload); err != nil {
+		return false, err
+	}
+	return result.On, nil
+}
+
+// QueryEnergy : Query instantaneous power draw in watts (SP3S)
+func (dev *BroadlinkDeviceSp2) QueryEnergy() (float64, error) {
+	var query packet.Sp2EnergyQueryResp
+	payload, err := query.Encode()
+	if err != nil {
+		return 0, err
+	}
+	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
+	resp, err := dev.SendPacket(0x6a, payload)
+	if err != nil {
+		return 0, err
+	}
+	frame, err := dev.decodeFrame(resp)
+	if err != nil {
+		return 0, err
+	}
+	var result packet.Sp2EnergyQueryResp
+	if err := result.Decode(frame.Payload); err != nil {
+		return 0, err
 	}
-	return false, nil
+	return result.Watts, nil
 }
 
 // SetPowerMask : On/Off Power Control
 func (dev *BroadlinkDeviceMp1) SetPowerMask(smask uint8, onstate bool) (bool, error) {
-
 	dev.LogMessage(5, fmt.Sprintln("POWERMASK=", smask))
-	vb2 := (smask << 1)
-	if !onstate {
-		vb2 = smask
-	}
-	vb2 += 0xb2
-	v0e := smask
-	if !onstate {
-		v0e = 0
+	payload, err := (&packet.Mp1MaskSet{Mask: smask, On: onstate}).Encode()
+	if err != nil {
+		return false, err
 	}
-	payload := make([]byte, 16)
-	copy(payload[0:], []byte{0x0d, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, vb2, 0xc0, 0x02, 0x00, 0x03, 0x00, 0x00, smask, v0e})
 	dev.LogMessage(10, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
-	_, err := dev.SendPacket(0x6a, payload)
+	_, err = dev.SendPacket(0x6a, payload)
 	if err != nil {
 		return false, err
 	}
@@ -267,23 +543,207 @@ func (dev *BroadlinkDeviceMp1) SetPowerMulti(no int, onstate bool) (bool, error)
 
 // QueryPowerRaw : Query Power
 func (dev *BroadlinkDeviceMp1) QueryPowerRaw() (uint, error) {
-	payload := make([]byte, 16)
-	copy(payload[0:], []byte{0x0a, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, 0xae, 0xc0, 0x01})
+	var query packet.Mp1QueryResp
+	payload, err := query.Encode()
+	if err != nil {
+		return 0, err
+	}
 	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
 	resp, err := dev.SendPacket(0x6a, payload)
 	if err != nil {
 		return 0, err
 	}
-	ierr := binary.LittleEndian.Uint16(resp[0x22:])
-	dev.LogMessage(10, fmt.Sprintln("RESP=", resp[0x22], resp[0x23], ierr))
-	if ierr != 0 {
-		return 0, fmt.Errorf("Response %x", ierr)
-	}	
-	dpayload, err := decrypt(dev.encKey, dev.encIv, resp[0x38:])
+	frame, err := dev.decodeFrame(resp)
 	if err != nil {
 		return 0, err
-	}	
-	return uint(dpayload[0x0e]), nil
+	}
+	var result packet.Mp1QueryResp
+	if err := result.Decode(frame.Payload); err != nil {
+		return 0, err
+	}
+	return uint(result.Raw), nil
+}
+
+//------------
+
+// EnterLearning : Put the device into IR learning mode
+func (dev *BroadlinkDeviceRm) EnterLearning() error {
+	payload := make([]byte, 16)
+	payload[0] = 0x03
+	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
+	_, err := dev.SendPacket(0x6a, payload)
+	return err
+}
+
+// CancelLearning : Cancel any IR/RF learning mode currently in progress
+func (dev *BroadlinkDeviceRm) CancelLearning() error {
+	payload := make([]byte, 16)
+	payload[0] = 0x1e
+	_, err := dev.SendPacket(0x6a, payload)
+	return err
+}
+
+// CheckData : Check whether a code has been captured by the last learning
+// attempt. Returns (nil, nil) while learning is still in progress.
+func (dev *BroadlinkDeviceRm) CheckData() ([]byte, error) {
+	payload := make([]byte, 16)
+	payload[0] = 0x04
+	resp, err := dev.SendPacket(0x6a, payload)
+	if err != nil {
+		return nil, err
+	}
+	var frame packet.Frame
+	if err := frame.Decode(dev.encKey, dev.encIv, resp); err != nil {
+		return nil, err
+	}
+	if frame.Err != 0 {
+		// Not a real error: the device just hasn't captured a code yet.
+		return nil, nil
+	}
+	var result packet.LearnResult
+	if err := result.Decode(frame.Payload); err != nil || len(result.Code) == 0 {
+		return nil, nil
+	}
+	return result.Code, nil
+}
+
+// SendCode : Transmit a previously learned IR/RF code
+func (dev *BroadlinkDeviceRm) SendCode(code []byte) (bool, error) {
+	payload, err := (&packet.SendCode{Code: code}).Encode()
+	if err != nil {
+		return false, err
+	}
+	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
+	_, err = dev.SendPacket(0x6a, payload)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LearnIR : Enter IR learning mode and poll CheckData until a code is
+// captured or timeout elapses
+func (dev *BroadlinkDeviceRm) LearnIR(timeout time.Duration) ([]byte, error) {
+	if err := dev.EnterLearning(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		code, err := dev.CheckData()
+		if err != nil {
+			dev.CancelLearning()
+			return nil, err
+		}
+		if code != nil {
+			return code, nil
+		}
+		time.Sleep(time.Second)
+	}
+	dev.CancelLearning()
+	return nil, errors.New("Timeout")
+}
+
+func (dev *BroadlinkDeviceRm) enterRFSweep() error {
+	payload := make([]byte, 16)
+	payload[0] = 0x19
+	_, err := dev.SendPacket(0x6a, payload)
+	return err
+}
+
+func (dev *BroadlinkDeviceRm) checkRFSweep() (bool, error) {
+	payload := make([]byte, 16)
+	payload[0] = 0x1a
+	resp, err := dev.SendPacket(0x6a, payload)
+	if err != nil {
+		return false, err
+	}
+	ierr := binary.LittleEndian.Uint16(resp[0x22:])
+	return ierr == 0, nil
+}
+
+func (dev *BroadlinkDeviceRm) cancelRFSweep() error {
+	payload := make([]byte, 16)
+	payload[0] = 0x1b
+	_, err := dev.SendPacket(0x6a, payload)
+	return err
+}
+
+// LearnRF : Sweep for the RF frequency of the remote, then learn the code on
+// that frequency. Each phase gets the full timeout.
+func (dev *BroadlinkDeviceRm) LearnRF(timeout time.Duration) ([]byte, error) {
+	if err := dev.enterRFSweep(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	locked := false
+	for time.Now().Before(deadline) {
+		found, err := dev.checkRFSweep()
+		if err != nil {
+			dev.cancelRFSweep()
+			return nil, err
+		}
+		if found {
+			locked = true
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	dev.cancelRFSweep()
+	if !locked {
+		return nil, errors.New("Timeout")
+	}
+	return dev.LearnIR(timeout)
+}
+
+//------------
+
+// QuerySensors : Query Temperature/Humidity/Light/AirQuality/Noise
+func (dev *BroadlinkDeviceA1) QuerySensors() (temp, humidity float32, light, airQuality, noise uint8, err error) {
+	payload := make([]byte, 16)
+	payload[0] = 1
+	dev.LogMessage(5, fmt.Sprintln("PAYLOAD=", hex.Dump(payload)))
+	resp, err := dev.SendPacket(0x6a, payload)
+	if err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	frame, err := dev.decodeFrame(resp)
+	if err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	dpayload := frame.Payload
+	temp = float32(dpayload[0x04]) + float32(dpayload[0x05])/10.0
+	humidity = float32(dpayload[0x06]) + float32(dpayload[0x07])/10.0
+	light = dpayload[0x08]
+	airQuality = dpayload[0x0a]
+	noise = dpayload[0x0c]
+	return temp, humidity, light, airQuality, noise, nil
+}
+
+// StreamSensors : Poll QuerySensors every interval until ctx is canceled,
+// publishing each reading (including any poll error) on the returned
+// channel, which is closed once polling stops
+func (dev *BroadlinkDeviceA1) StreamSensors(ctx context.Context, interval time.Duration) (<-chan SensorReading, error) {
+	ch := make(chan SensorReading)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				temp, humidity, light, airQuality, noise, err := dev.QuerySensors()
+				reading := SensorReading{Temp: temp, Humidity: humidity, Light: light, AirQuality: airQuality, Noise: noise, Err: err}
+				select {
+				case ch <- reading:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
 }
 
 //----
@@ -349,75 +809,103 @@ func decrypt(key []byte, iv []byte, encText []byte) ([]byte, error) {
 
 // -------
 
-// RecvResponse : Recv Response
+// RecvResponse : Receive the next unsolicited packet, i.e. one that did not
+// match any in-flight request's SendCount (such as a broadcast/hello reply)
 func (dev *BroadlinkDevice) RecvResponse(timeout time.Duration) ([]byte, error) {
-	for {
-		select {
-		case buf := <-dev.responses:
-			return buf, nil
+	select {
+	case buf := <-dev.unsolicited:
+		return buf, nil
 
-		case <-time.After(timeout * time.Second):
-			return nil, errors.New("Timeout")
-		}
+	case <-time.After(timeout * time.Second):
+		return nil, errors.New("Timeout")
 	}
 }
 
-func (dev *BroadlinkDevice) wait4Response(expectedType uint16, timeout time.Duration) ([]byte, error) {
-	startTime := time.Now().Add(timeout * time.Second)
-	for {
-		select {
-		case buf := <-dev.responses:
-			msgType := binary.LittleEndian.Uint16(buf[0x26:0x28])
-			if msgType == expectedType {
-				return buf, nil
-			}
+// waitResponse : Wait for the reply correlated with sendCount, as registered
+// by RawSendPacket, or time out
+func (dev *BroadlinkDevice) waitResponse(sendCount uint16, timeout time.Duration) ([]byte, error) {
+	dev.responsesLock.Lock()
+	ch := dev.responses[sendCount]
+	dev.responsesLock.Unlock()
+	if ch == nil {
+		return nil, errors.New("unknown send count")
+	}
 
-			dev.responses <- buf
-			if !time.Now().Before(startTime) {
-				return nil, errors.New("Check time")
-			}
-		case <-time.After(timeout * time.Second):
-			return nil, errors.New("Timeout")
-		}
+	select {
+	case buf := <-ch:
+		return buf, nil
+	case <-time.After(timeout * time.Second):
+		dev.responsesLock.Lock()
+		delete(dev.responses, sendCount)
+		dev.responsesLock.Unlock()
+		return nil, errors.New("Timeout")
 	}
 }
 
-// RawSendPacket : Send Packet (W/O Response)
-func (dev *BroadlinkDevice) RawSendPacket(command uint16, payload []byte) (bool, error) {
-	dev.SendCount++
-
-	packet := make([]byte, 0x38)
-	copy(packet[0:], []byte{0x5a, 0xa5, 0xaa, 0x55, 0x5a, 0xa5, 0xaa, 0x55, 0x00})
-	binary.LittleEndian.PutUint16(packet[0x24:], dev.DevType)
-	binary.LittleEndian.PutUint16(packet[0x26:], command)
-	binary.LittleEndian.PutUint16(packet[0x28:], dev.SendCount)
-	copy(packet[0x2a:], dev.HwMac[0:])
-	binary.LittleEndian.PutUint32(packet[0x30:], dev.DevID)
-
-	if (payload != nil) && (len(payload) > 0) {
-		payload = padding(payload, aes.BlockSize)
-		binary.LittleEndian.PutUint16(packet[0x34:], calcChecksum(payload))
-		encrypted, _ := encrypt(dev.encKey, dev.encIv, payload)
-		packet = append(packet, encrypted...)
+func (dev *BroadlinkDevice) wait4Response(sendCount uint16, expectedType uint16, timeout time.Duration) ([]byte, error) {
+	buf, err := dev.waitResponse(sendCount, timeout)
+	if err != nil {
+		return nil, err
 	}
+	if msgType := binary.LittleEndian.Uint16(buf[0x26:0x28]); msgType != expectedType {
+		return nil, fmt.Errorf("unexpected response type %x", msgType)
+	}
+	return buf, nil
+}
 
-	binary.LittleEndian.PutUint16(packet[0x20:], calcChecksum(packet))
+// RawSendPacket : Send Packet (W/O Response). Returns the SendCount used for
+// this request, which callers pass to waitResponse to correlate the reply.
+func (dev *BroadlinkDevice) RawSendPacket(command uint16, payload []byte) (uint16, error) {
+	dev.responsesLock.Lock()
+	dev.SendCount++
+	sendCount := dev.SendCount
+	dev.responses[sendCount] = make(chan []byte, 1)
+	dev.responsesLock.Unlock()
+
+	frame := packet.Frame{
+		DevType:   dev.DevType,
+		Command:   command,
+		SendCount: sendCount,
+		HwMac:     dev.HwMac,
+		DevID:     dev.DevID,
+		Payload:   payload,
+	}
+	raw, err := frame.Encode(dev.encKey, dev.encIv)
+	if err != nil {
+		dev.responsesLock.Lock()
+		delete(dev.responses, sendCount)
+		dev.responsesLock.Unlock()
+		return sendCount, err
+	}
 
 	dev.LogMessage(20, fmt.Sprintln(hex.Dump(payload)))
-	dev.LogMessage(20, fmt.Sprintln(hex.Dump(packet)))
+	dev.LogMessage(20, fmt.Sprintln(hex.Dump(raw)))
+
+	bind := dev.getBind()
+	if bind == nil {
+		dev.responsesLock.Lock()
+		delete(dev.responses, sendCount)
+		dev.responsesLock.Unlock()
+		return sendCount, errors.New("bind closed")
+	}
 
-	dev.CS.WriteToUDP(packet, dev.IPAddr)
-	return true, nil
+	if err := bind.Send(raw, dev.Peer); err != nil {
+		dev.responsesLock.Lock()
+		delete(dev.responses, sendCount)
+		dev.responsesLock.Unlock()
+		return sendCount, err
+	}
+	return sendCount, nil
 }
 
 // SendPacket : Send Packet
 func (dev *BroadlinkDevice) SendPacket(command uint16, payload []byte) ([]byte, error) {
-	_, err := dev.RawSendPacket(command, payload)
+	sendCount, err := dev.RawSendPacket(command, payload)
 	if err != nil {
 		return nil, err
 	}
 	dev.LogMessage(10, fmt.Sprintln("WAIT FOR RESP"))
-	resp, err := dev.RecvResponse(time.Duration(1))
+	resp, err := dev.waitResponse(sendCount, time.Duration(1))
 	dev.LogMessage(10, fmt.Sprintln("GOT RESP", err))
 	if err != nil {
 		return nil, err
@@ -425,17 +913,34 @@ func (dev *BroadlinkDevice) SendPacket(command uint16, payload []byte) ([]byte,
 	return resp, nil
 }
 
+// decodeFrame : Parse a raw response into a packet.Frame, decrypting its
+// payload and checking its error code in one place instead of each caller
+// hand-rolling the resp[0x22:] check and decrypt(dev.encKey, dev.encIv, ...) call
+func (dev *BroadlinkDevice) decodeFrame(resp []byte) (*packet.Frame, error) {
+	var frame packet.Frame
+	if err := frame.Decode(dev.encKey, dev.encIv, resp); err != nil {
+		return nil, err
+	}
+	if frame.Err != 0 {
+		return nil, fmt.Errorf("Response %x", frame.Err)
+	}
+	return &frame, nil
+}
+
 // Auth : Authenticate
 func (dev *BroadlinkDevice) Auth() (bool, error) {
-	payload := make([]byte, 0x50)
-	payload[0x2d] = 0x01
-
 	hostname, _ := os.Hostname()
-	copy(payload[0x30:], []byte(hostname))
+	payload, err := (&packet.AuthRequest{Hostname: hostname}).Encode()
+	if err != nil {
+		return false, err
+	}
 
-	dev.RawSendPacket(0x65, payload)
+	sendCount, err := dev.RawSendPacket(0x65, payload)
+	if err != nil {
+		return false, err
+	}
 
-	resp, err := dev.wait4Response(0x3e9, dev.TimeoutDefault)
+	resp, err := dev.wait4Response(sendCount, 0x3e9, dev.TimeoutDefault)
 	if err != nil {
 		return false, err
 	}
@@ -443,9 +948,16 @@ func (dev *BroadlinkDevice) Auth() (bool, error) {
 	if len(resp) >= 0x38 {
 		dev.LogMessage(10, fmt.Sprintln("RESPONSE"))
 		dev.LogMessage(10, fmt.Sprintln(hex.Dump(resp)))
-		decrypted, _ := decrypt(dev.encKey, dev.encIv, resp[0x38:])
-		dev.DevID = binary.LittleEndian.Uint32(decrypted[0x00:])
-		dev.encKey = decrypted[0x04:0x14]
+		frame, err := dev.decodeFrame(resp)
+		if err != nil {
+			return false, err
+		}
+		var authResp packet.AuthResponse
+		if err := authResp.Decode(frame.Payload); err != nil {
+			return false, err
+		}
+		dev.DevID = authResp.DevID
+		dev.encKey = authResp.Key
 		dev.LogMessage(2, fmt.Sprintln("Device Id=", dev.DevID))
 	}
 	return true, nil
@@ -0,0 +1,450 @@
+package broadlinkzard
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rmFixtureHandler decides how the fake device responds to a given command.
+// It returns the decrypted response payload (nil if the reply carries none)
+// and the error code that belongs at offset 0x22 of the response header.
+type rmFixtureHandler func(cmd uint16, payload []byte) (respPayload []byte, ierr uint16)
+
+// startRmFixtureServer starts a loopback UDP server that replays canned
+// packet fixtures for an RM device, so the learning/sending round-trip can
+// be exercised without a real device on the network.
+func startRmFixtureServer(t *testing.T, dev *BroadlinkDeviceRm, handler rmFixtureHandler) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packet := make([]byte, n)
+			copy(packet, buf[:n])
+
+			cmd := binary.LittleEndian.Uint16(packet[0x26:0x28])
+			sendCount := binary.LittleEndian.Uint16(packet[0x28:0x2a])
+
+			var reqPayload []byte
+			if len(packet) > 0x38 {
+				decrypted, err := decrypt(dev.encKey, dev.encIv, packet[0x38:])
+				if err == nil {
+					reqPayload = decrypted
+				}
+			}
+
+			respPayload, ierr := handler(cmd, reqPayload)
+			conn.WriteToUDP(buildRmFixtureResponse(dev, sendCount, ierr, respPayload), addr)
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func buildRmFixtureResponse(dev *BroadlinkDeviceRm, sendCount uint16, ierr uint16, payload []byte) []byte {
+	packet := make([]byte, 0x38)
+	binary.LittleEndian.PutUint16(packet[0x22:], ierr)
+	binary.LittleEndian.PutUint16(packet[0x28:], sendCount)
+	if ierr == 0 && payload != nil {
+		encrypted, _ := encrypt(dev.encKey, dev.encIv, payload)
+		packet = append(packet, encrypted...)
+	}
+	binary.LittleEndian.PutUint16(packet[0x20:], calcChecksum(packet))
+	return packet
+}
+
+func newTestRmDevice(t *testing.T, handler rmFixtureHandler) *BroadlinkDeviceRm {
+	t.Helper()
+	var dev BroadlinkDeviceRm
+	dev.DevType = 0x2712
+	dev.initVars()
+
+	server := startRmFixtureServer(t, &dev, handler)
+	dev.Peer = Endpoint{Addr: server.LocalAddr().(*net.UDPAddr)}
+
+	t.Cleanup(dev.Close)
+	return &dev
+}
+
+func TestRmLearnIR(t *testing.T) {
+	var mu sync.Mutex
+	checks := 0
+	dev := newTestRmDevice(t, func(cmd uint16, payload []byte) ([]byte, uint16) {
+		if cmd != 0x6a {
+			return nil, 0
+		}
+		switch payload[0] {
+		case 0x03, 0x1e: // enter/cancel learning, ack only
+			return []byte{payload[0], 0, 0, 0}, 0
+		case 0x04: // check data
+			mu.Lock()
+			checks++
+			n := checks
+			mu.Unlock()
+			if n < 2 {
+				return nil, 0xfff1 // still learning
+			}
+			return []byte{0x04, 0, 0, 0, 0xde, 0xad, 0xbe, 0xef}, 0
+		}
+		return nil, 0
+	})
+
+	code, err := dev.LearnIR(5 * time.Second)
+	if err != nil {
+		t.Fatalf("LearnIR failed: %v", err)
+	}
+	want := []byte{0xde, 0xad, 0xbe, 0xef}
+	if !bytes.HasPrefix(code, want) {
+		t.Fatalf("got code %x, want prefix %x", code, want)
+	}
+	mu.Lock()
+	gotChecks := checks
+	mu.Unlock()
+	if gotChecks < 2 {
+		t.Fatalf("expected CheckData to be polled at least twice, got %d", gotChecks)
+	}
+}
+
+func TestRmSendCode(t *testing.T) {
+	var mu sync.Mutex
+	var sent []byte
+	dev := newTestRmDevice(t, func(cmd uint16, payload []byte) ([]byte, uint16) {
+		if cmd == 0x6a && payload[0] == 0x02 {
+			mu.Lock()
+			sent = append([]byte(nil), payload[4:]...)
+			mu.Unlock()
+		}
+		return nil, 0
+	})
+
+	code := []byte{0x26, 0x00, 0x01, 0x02}
+	ok, err := dev.SendCode(code)
+	if err != nil || !ok {
+		t.Fatalf("SendCode failed: ok=%v err=%v", ok, err)
+	}
+	mu.Lock()
+	gotSent := sent
+	mu.Unlock()
+	if !bytes.HasPrefix(gotSent, code) {
+		t.Fatalf("device received %x, want prefix %x", gotSent, code)
+	}
+}
+
+func TestRmLearnRF(t *testing.T) {
+	sweepChecks := 0
+	dev := newTestRmDevice(t, func(cmd uint16, payload []byte) ([]byte, uint16) {
+		if cmd != 0x6a {
+			return nil, 0
+		}
+		switch payload[0] {
+		case 0x19, 0x1b: // enter/cancel sweep, ack only
+			return []byte{payload[0], 0, 0, 0}, 0
+		case 0x1a: // check sweep
+			sweepChecks++
+			if sweepChecks < 2 {
+				return nil, 0xfff1 // frequency not locked yet
+			}
+			return []byte{0x1a, 0, 0, 0}, 0
+		case 0x03, 0x1e:
+			return []byte{payload[0], 0, 0, 0}, 0
+		case 0x04:
+			return []byte{0x04, 0, 0, 0, 0xca, 0xfe}, 0
+		}
+		return nil, 0
+	})
+
+	code, err := dev.LearnRF(5 * time.Second)
+	if err != nil {
+		t.Fatalf("LearnRF failed: %v", err)
+	}
+	want := []byte{0xca, 0xfe}
+	if !bytes.HasPrefix(code, want) {
+		t.Fatalf("got code %x, want prefix %x", code, want)
+	}
+}
+
+func TestBuildHelloPacket(t *testing.T) {
+	packet, err := buildHelloPacket(net.IPv4(192, 168, 1, 50), 12345)
+	if err != nil {
+		t.Fatalf("buildHelloPacket failed: %v", err)
+	}
+
+	if len(packet) != 0x30 {
+		t.Fatalf("got packet length %d, want 0x30", len(packet))
+	}
+	if !checkChecksum(packet, 0x20) {
+		t.Fatalf("checksum at 0x20 does not validate")
+	}
+	if cmd := binary.LittleEndian.Uint16(packet[0x26:0x28]); cmd != 0x06 {
+		t.Fatalf("got command %x, want 0x06", cmd)
+	}
+	wantIP := []byte{50, 1, 168, 192}
+	if !bytes.Equal(packet[0x18:0x1c], wantIP) {
+		t.Fatalf("got reversed IP %x, want %x", packet[0x18:0x1c], wantIP)
+	}
+	if port := binary.LittleEndian.Uint16(packet[0x1c:0x1e]); port != 12345 {
+		t.Fatalf("got source port %d, want 12345", port)
+	}
+}
+
+// buildFixtureResponse builds a well-formed response packet for a MemoryBind
+// fixture, carrying command, sendCount and an (optionally encrypted) payload.
+func buildFixtureResponse(key, iv []byte, cmd, sendCount uint16, payload []byte) []byte {
+	packet := make([]byte, 0x38)
+	binary.LittleEndian.PutUint16(packet[0x26:], cmd)
+	binary.LittleEndian.PutUint16(packet[0x28:], sendCount)
+	if payload != nil {
+		encrypted, _ := encrypt(key, iv, payload)
+		packet = append(packet, encrypted...)
+	}
+	binary.LittleEndian.PutUint16(packet[0x20:], calcChecksum(packet))
+	return packet
+}
+
+func TestAuthViaMemoryBind(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDevice
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	wantDevID := uint32(0xcafef00d)
+	wantKey := []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00}
+
+	go func() {
+		sent := <-bind.Sent
+		sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+
+		respPayload := make([]byte, 0x14)
+		binary.LittleEndian.PutUint32(respPayload[0x00:], wantDevID)
+		copy(respPayload[0x04:0x14], wantKey)
+
+		resp := buildFixtureResponse(dev.encKey, dev.encIv, 0x3e9, sendCount, respPayload)
+		bind.Deliver(resp, sent.Peer)
+	}()
+
+	ok, err := dev.Auth()
+	if err != nil || !ok {
+		t.Fatalf("Auth failed: ok=%v err=%v", ok, err)
+	}
+	if dev.DevID != wantDevID {
+		t.Fatalf("got DevID %x, want %x", dev.DevID, wantDevID)
+	}
+	if string(dev.encKey) != string(wantKey) {
+		t.Fatalf("got key %x, want %x", dev.encKey, wantKey)
+	}
+}
+
+func TestSp2SetPowerViaMemoryBind(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDeviceSp2
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	go func() {
+		sent := <-bind.Sent
+		sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+		bind.Deliver(buildFixtureResponse(dev.encKey, dev.encIv, 0, sendCount, nil), sent.Peer)
+	}()
+
+	ok, err := dev.SetPower(true)
+	if err != nil || !ok {
+		t.Fatalf("SetPower failed: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestConcurrentSetPower(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDeviceSp2
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	const n = 20
+	go func() {
+		for i := 0; i < n; i++ {
+			sent := <-bind.Sent
+			sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+			resp := buildFixtureResponse(dev.encKey, dev.encIv, 0, sendCount, nil)
+			go bind.Deliver(resp, sent.Peer)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := dev.SetPower(true); err != nil || !ok {
+				t.Errorf("SetPower failed: ok=%v err=%v", ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestSendPacketConcurrentCorrelation guards against SendCount replies being
+// delivered to the wrong caller: each goroutine embeds its own index in the
+// request payload, the fake device echoes the payload back, and each
+// goroutine checks it got the reply for its own request.
+func TestSendPacketConcurrentCorrelation(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDevice
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	const n = 30
+	go func() {
+		for i := 0; i < n; i++ {
+			sent := <-bind.Sent
+			sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+			reqPayload, err := decrypt(dev.encKey, dev.encIv, sent.Packet[0x38:])
+			if err != nil {
+				continue
+			}
+			resp := buildFixtureResponse(dev.encKey, dev.encIv, 0x6a, sendCount, reqPayload)
+			go bind.Deliver(resp, sent.Peer)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := make([]byte, 16)
+			binary.LittleEndian.PutUint16(payload[0:], uint16(i))
+
+			resp, err := dev.SendPacket(0x6a, payload)
+			if err != nil {
+				t.Errorf("goroutine %d: SendPacket failed: %v", i, err)
+				return
+			}
+			dpayload, err := decrypt(dev.encKey, dev.encIv, resp[0x38:])
+			if err != nil {
+				t.Errorf("goroutine %d: decrypt failed: %v", i, err)
+				return
+			}
+			if got := binary.LittleEndian.Uint16(dpayload[0:]); got != uint16(i) {
+				t.Errorf("goroutine %d got the reply for request %d", i, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSp2QueryEnergy(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDeviceSp2
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	go func() {
+		sent := <-bind.Sent
+		sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+		respPayload := make([]byte, 16)
+		respPayload[0x07] = 0x34 // b0: fractional watts, BCD-ish per protocol
+		respPayload[0x08] = 0x12 // b1
+		respPayload[0x09] = 0x00 // b2
+		bind.Deliver(buildFixtureResponse(dev.encKey, dev.encIv, 0, sendCount, respPayload), sent.Peer)
+	}()
+
+	watts, err := dev.QueryEnergy()
+	if err != nil {
+		t.Fatalf("QueryEnergy failed: %v", err)
+	}
+	want := (0*256.0 + 0x12 + 0x34/100.0) / 100.0
+	if watts != want {
+		t.Fatalf("got %v watts, want %v", watts, want)
+	}
+}
+
+func TestA1QuerySensors(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDeviceA1
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	go func() {
+		for {
+			sent, ok := <-bind.Sent
+			if !ok {
+				return
+			}
+			sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+			respPayload := make([]byte, 16)
+			respPayload[0x04] = 22 // temp whole
+			respPayload[0x05] = 5  // temp fraction
+			respPayload[0x06] = 45 // humidity whole
+			respPayload[0x07] = 0  // humidity fraction
+			respPayload[0x08] = 1  // light
+			respPayload[0x0a] = 2  // air quality
+			respPayload[0x0c] = 3  // noise
+			bind.Deliver(buildFixtureResponse(dev.encKey, dev.encIv, 0, sendCount, respPayload), sent.Peer)
+		}
+	}()
+
+	temp, humidity, light, airQuality, noise, err := dev.QuerySensors()
+	if err != nil {
+		t.Fatalf("QuerySensors failed: %v", err)
+	}
+	if temp != 22.5 || humidity != 45.0 || light != 1 || airQuality != 2 || noise != 3 {
+		t.Fatalf("got temp=%v humidity=%v light=%v airQuality=%v noise=%v", temp, humidity, light, airQuality, noise)
+	}
+}
+
+func TestA1StreamSensors(t *testing.T) {
+	bind := NewMemoryBind()
+	var dev BroadlinkDeviceA1
+	dev.bind = bind
+	dev.initVars()
+	defer dev.Close()
+
+	go func() {
+		for {
+			sent, ok := <-bind.Sent
+			if !ok {
+				return
+			}
+			sendCount := binary.LittleEndian.Uint16(sent.Packet[0x28:0x2a])
+			respPayload := make([]byte, 16)
+			respPayload[0x04] = 20
+			bind.Deliver(buildFixtureResponse(dev.encKey, dev.encIv, 0, sendCount, respPayload), sent.Peer)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readings, err := dev.StreamSensors(ctx, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("StreamSensors failed: %v", err)
+	}
+
+	reading := <-readings
+	if reading.Err != nil {
+		t.Fatalf("reading error: %v", reading.Err)
+	}
+	if reading.Temp != 20 {
+		t.Fatalf("got temp %v, want 20", reading.Temp)
+	}
+
+	cancel()
+	for range readings {
+		// drain until the channel closes
+	}
+}
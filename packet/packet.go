@@ -0,0 +1,410 @@
+// Package packet provides typed Encode/Decode representations of the
+// Broadlink UDP payloads, plus Frame, which assembles/parses the 0x38-byte
+// packet header shared by every command.
+package packet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Codec : A payload that can be serialized to and parsed from the raw bytes
+// carried inside a Frame
+type Codec interface {
+	Encode() ([]byte, error)
+	Decode([]byte) error
+}
+
+// AuthRequest : The auth handshake payload sent to claim a device
+type AuthRequest struct {
+	Hostname string
+}
+
+// Encode : Build the 0x50-byte auth request payload
+func (p *AuthRequest) Encode() ([]byte, error) {
+	payload := make([]byte, 0x50)
+	payload[0x2d] = 0x01
+	copy(payload[0x30:], []byte(p.Hostname))
+	return payload, nil
+}
+
+// Decode : AuthRequest is encode-only
+func (p *AuthRequest) Decode([]byte) error {
+	return errors.New("AuthRequest is encode-only")
+}
+
+// AuthResponse : The device ID and session key returned by a successful auth
+type AuthResponse struct {
+	DevID uint32
+	Key   []byte
+}
+
+// Encode : AuthResponse is decode-only
+func (p *AuthResponse) Encode() ([]byte, error) {
+	return nil, errors.New("AuthResponse is decode-only")
+}
+
+// Decode : Parse the device ID and session key from a decrypted auth response
+func (p *AuthResponse) Decode(data []byte) error {
+	if len(data) < 0x14 {
+		return errors.New("auth response too short")
+	}
+	p.DevID = binary.LittleEndian.Uint32(data[0x00:])
+	p.Key = append([]byte(nil), data[0x04:0x14]...)
+	return nil
+}
+
+// Sp2PowerSet : SP2 set-power request payload
+type Sp2PowerSet struct {
+	On bool
+}
+
+// Encode : Build the set-power payload
+func (p *Sp2PowerSet) Encode() ([]byte, error) {
+	payload := make([]byte, 16)
+	payload[0] = 2
+	if p.On {
+		payload[4] = 1
+	}
+	return payload, nil
+}
+
+// Decode : Parse a set-power payload back into its On state
+func (p *Sp2PowerSet) Decode(data []byte) error {
+	if len(data) < 5 {
+		return errors.New("sp2 power set payload too short")
+	}
+	p.On = data[4] != 0
+	return nil
+}
+
+// Sp2PowerQueryResp : SP2 query-power response payload
+type Sp2PowerQueryResp struct {
+	On bool
+}
+
+// Encode : Build the query-power request payload
+func (p *Sp2PowerQueryResp) Encode() ([]byte, error) {
+	payload := make([]byte, 16)
+	payload[0] = 1
+	return payload, nil
+}
+
+// Decode : Parse the decrypted query-power response into its On state
+func (p *Sp2PowerQueryResp) Decode(data []byte) error {
+	if len(data) < 5 {
+		return errors.New("sp2 power query response too short")
+	}
+	p.On = data[4] == 1 || data[4] == 3 || data[4] == 0xfd
+	return nil
+}
+
+// Sp2EnergyQueryResp : SP3S instantaneous power query/response payload
+type Sp2EnergyQueryResp struct {
+	Watts float64
+}
+
+// Encode : Build the query-energy request payload
+func (p *Sp2EnergyQueryResp) Encode() ([]byte, error) {
+	payload := make([]byte, 16)
+	copy(payload[0:], []byte{0x08, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, 0xc1, 0xb7, 0x01})
+	return payload, nil
+}
+
+// Decode : Parse the decrypted query-energy response's three BCD bytes into Watts
+func (p *Sp2EnergyQueryResp) Decode(data []byte) error {
+	if len(data) < 0x0a {
+		return errors.New("sp2 energy query response too short")
+	}
+	b0 := float64(data[0x07])
+	b1 := float64(data[0x08])
+	b2 := float64(data[0x09])
+	p.Watts = (b2*256 + b1 + b0/100.0) / 100.0
+	return nil
+}
+
+// Mp1MaskSet : MP1 per-outlet set-power request payload
+type Mp1MaskSet struct {
+	Mask uint8
+	On   bool
+}
+
+// Encode : Build the set-power-mask payload
+func (p *Mp1MaskSet) Encode() ([]byte, error) {
+	vb2 := p.Mask << 1
+	if !p.On {
+		vb2 = p.Mask
+	}
+	vb2 += 0xb2
+	v0e := p.Mask
+	if !p.On {
+		v0e = 0
+	}
+	payload := make([]byte, 16)
+	copy(payload[0:], []byte{0x0d, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, vb2, 0xc0, 0x02, 0x00, 0x03, 0x00, 0x00, p.Mask, v0e})
+	return payload, nil
+}
+
+// Decode : Mp1MaskSet is encode-only
+func (p *Mp1MaskSet) Decode([]byte) error {
+	return errors.New("Mp1MaskSet is encode-only")
+}
+
+// Mp1QueryResp : MP1 query-power response payload
+type Mp1QueryResp struct {
+	Raw uint8
+}
+
+// Encode : Build the query-power request payload
+func (p *Mp1QueryResp) Encode() ([]byte, error) {
+	payload := make([]byte, 16)
+	copy(payload[0:], []byte{0x0a, 0x00, 0xa5, 0xa5, 0x5a, 0x5a, 0xae, 0xc0, 0x01})
+	return payload, nil
+}
+
+// Decode : Parse the decrypted query-power response into its raw outlet mask
+func (p *Mp1QueryResp) Decode(data []byte) error {
+	if len(data) < 0x0f {
+		return errors.New("mp1 query response too short")
+	}
+	p.Raw = data[0x0e]
+	return nil
+}
+
+// SendCode : RM payload for transmitting a previously learned IR/RF code
+type SendCode struct {
+	Code []byte
+}
+
+// Encode : Prepend the 4-byte opcode header and the code bytes
+func (p *SendCode) Encode() ([]byte, error) {
+	payload := make([]byte, 4+len(p.Code))
+	payload[0] = 0x02
+	copy(payload[4:], p.Code)
+	return payload, nil
+}
+
+// Decode : Parse a send-code payload back into its code bytes
+func (p *SendCode) Decode(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("send code payload too short")
+	}
+	if data[0] != 0x02 {
+		return fmt.Errorf("unexpected opcode %x", data[0])
+	}
+	p.Code = append([]byte(nil), data[4:]...)
+	return nil
+}
+
+// LearnResult : The learned IR/RF code returned by an RM check-data reply
+type LearnResult struct {
+	Code []byte
+}
+
+// Encode : Prepend the 4-byte header expected ahead of a learned code
+func (p *LearnResult) Encode() ([]byte, error) {
+	payload := make([]byte, 4+len(p.Code))
+	payload[0] = 0x04
+	copy(payload[4:], p.Code)
+	return payload, nil
+}
+
+// Decode : Parse a check-data reply into its learned code bytes
+func (p *LearnResult) Decode(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("learn result too short")
+	}
+	p.Code = append([]byte(nil), data[4:]...)
+	return nil
+}
+
+// HelloRequest : The discovery broadcast hello packet
+type HelloRequest struct {
+	LocalIP   net.IP
+	LocalPort int
+	Now       time.Time
+}
+
+// Encode : Build the 0x30-byte discovery hello packet
+func (p *HelloRequest) Encode() ([]byte, error) {
+	packet := make([]byte, 0x30)
+
+	_, tzOffset := p.Now.Zone()
+	binary.LittleEndian.PutUint32(packet[0x08:], uint32(int32(tzOffset)))
+
+	binary.LittleEndian.PutUint16(packet[0x0c:], uint16(p.Now.Year()))
+	packet[0x0e] = byte(p.Now.Second())
+	packet[0x0f] = byte(p.Now.Minute())
+	packet[0x10] = byte(p.Now.Hour())
+	packet[0x11] = byte(p.Now.Day())
+	packet[0x12] = byte(p.Now.Month())
+	packet[0x13] = byte(p.Now.Weekday())
+
+	ip4 := p.LocalIP.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+	packet[0x18] = ip4[3]
+	packet[0x19] = ip4[2]
+	packet[0x1a] = ip4[1]
+	packet[0x1b] = ip4[0]
+
+	binary.LittleEndian.PutUint16(packet[0x1c:], uint16(p.LocalPort))
+	binary.LittleEndian.PutUint16(packet[0x26:], 0x06)
+	binary.LittleEndian.PutUint16(packet[0x20:], checksum(packet))
+
+	return packet, nil
+}
+
+// Decode : HelloRequest is encode-only
+func (p *HelloRequest) Decode([]byte) error {
+	return errors.New("HelloRequest is encode-only")
+}
+
+// HelloResponse : A discovery reply identifying a device
+type HelloResponse struct {
+	DevType uint16
+	IP      net.IP
+	Mac     net.HardwareAddr
+}
+
+// Encode : HelloResponse is decode-only
+func (p *HelloResponse) Encode() ([]byte, error) {
+	return nil, errors.New("HelloResponse is decode-only")
+}
+
+// Decode : Parse a discovery reply into its device type, IP and MAC
+func (p *HelloResponse) Decode(data []byte) error {
+	if len(data) < 0x40 || !verifyChecksum(data, 0x20) {
+		return errors.New("invalid hello response")
+	}
+	if binary.LittleEndian.Uint16(data[0x26:0x28]) != 0x07 {
+		return errors.New("unexpected command")
+	}
+	p.DevType = binary.LittleEndian.Uint16(data[0x34:0x36])
+	p.IP = net.IPv4(data[0x39], data[0x38], data[0x37], data[0x36])
+	mac := make(net.HardwareAddr, 6)
+	for i := 0; i < 6; i++ {
+		mac[i] = data[0x3f-i]
+	}
+	p.Mac = mac
+	return nil
+}
+
+// Frame : The 0x38-byte packet header shared by every command, plus its
+// AES-CBC encrypted payload. Encode/Decode compute both checksums (0x20 for
+// the whole packet, 0x34 for the plaintext payload) and apply padding in one
+// place.
+type Frame struct {
+	DevType   uint16
+	Command   uint16
+	SendCount uint16
+	HwMac     [6]byte
+	DevID     uint32
+	Err       uint16
+	Payload   []byte
+}
+
+// Encode : Build the raw packet bytes for this frame, encrypting Payload
+// with key/iv if one is present
+func (f *Frame) Encode(key, iv []byte) ([]byte, error) {
+	packet := make([]byte, 0x38)
+	copy(packet[0:], []byte{0x5a, 0xa5, 0xaa, 0x55, 0x5a, 0xa5, 0xaa, 0x55, 0x00})
+	binary.LittleEndian.PutUint16(packet[0x24:], f.DevType)
+	binary.LittleEndian.PutUint16(packet[0x26:], f.Command)
+	binary.LittleEndian.PutUint16(packet[0x28:], f.SendCount)
+	copy(packet[0x2a:], f.HwMac[:])
+	binary.LittleEndian.PutUint32(packet[0x30:], f.DevID)
+
+	if len(f.Payload) > 0 {
+		padded := pad(f.Payload, aes.BlockSize)
+		binary.LittleEndian.PutUint16(packet[0x34:], checksum(padded))
+		encrypted, err := encrypt(key, iv, padded)
+		if err != nil {
+			return nil, err
+		}
+		packet = append(packet, encrypted...)
+	}
+
+	binary.LittleEndian.PutUint16(packet[0x20:], checksum(packet))
+	return packet, nil
+}
+
+// Decode : Parse raw packet bytes into this frame, decrypting the payload
+// with key/iv if one is present
+func (f *Frame) Decode(key, iv, raw []byte) error {
+	if len(raw) < 0x38 {
+		return errors.New("frame too short")
+	}
+	if !verifyChecksum(raw, 0x20) {
+		return errors.New("checksum mismatch")
+	}
+	f.Err = binary.LittleEndian.Uint16(raw[0x22:0x24])
+	f.DevType = binary.LittleEndian.Uint16(raw[0x24:0x26])
+	f.Command = binary.LittleEndian.Uint16(raw[0x26:0x28])
+	f.SendCount = binary.LittleEndian.Uint16(raw[0x28:0x2a])
+	copy(f.HwMac[:], raw[0x2a:0x30])
+	f.DevID = binary.LittleEndian.Uint32(raw[0x30:0x34])
+
+	if len(raw) > 0x38 {
+		decrypted, err := decrypt(key, iv, raw[0x38:])
+		if err != nil {
+			return err
+		}
+		f.Payload = decrypted
+	}
+	return nil
+}
+
+func pad(b []byte, blockSize int) []byte {
+	padded := make([]byte, len(b))
+	copy(padded, b)
+	if rem := len(padded) % blockSize; rem != 0 {
+		padded = append(padded, bytes.Repeat([]byte{0x00}, blockSize-rem)...)
+	}
+	return padded
+}
+
+func checksum(payload []byte) uint16 {
+	sum := uint16(0xbeaf)
+	for _, val := range payload {
+		sum += uint16(val)
+	}
+	return sum
+}
+
+func verifyChecksum(payload []byte, pos int) bool {
+	cp := make([]byte, len(payload))
+	copy(cp, payload)
+	binary.LittleEndian.PutUint16(cp[pos:pos+2], 0)
+	return checksum(cp) == binary.LittleEndian.Uint16(payload[pos:pos+2])
+}
+
+func encrypt(key, iv, text []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(text))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, text)
+	return ciphertext, nil
+}
+
+func decrypt(key, iv, encText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encText) < aes.BlockSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	decrypted := make([]byte, len(encText))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encText)
+	return decrypted, nil
+}